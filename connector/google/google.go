@@ -11,14 +11,17 @@ import (
 	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/hashicorp/golang-lru/v2/expirable"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
 	admin "google.golang.org/api/admin/directory/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/impersonate"
 	"google.golang.org/api/option"
 
 	"github.com/dexidp/dex/connector"
-	pkg_groups "github.com/dexidp/dex/pkg/groups"
 	"github.com/dexidp/dex/pkg/log"
 )
 
@@ -40,6 +43,11 @@ type Config struct {
 
 	// Optional list of whitelisted groups
 	// If this field is nonempty, only users from a listed group will be allowed to log in
+	// Entries must be a valid Directory API groupKey (the group's email, alias, or unique ID) --
+	// this is independent of GroupsKey below, which only controls the format of the Identity.Groups
+	// this connector returns, not how allow-listed groups are looked up. Membership in a listed
+	// group is checked with the Directory API's hasMember, which counts nested membership whether
+	// or not FetchTransitiveGroupMembership is set.
 	Groups []string `json:"groups"`
 
 	// Optional path to service account json
@@ -52,6 +60,18 @@ type Config struct {
 	// when listing groups
 	AdminEmail string
 
+	// Optional email of a service account to impersonate in order to obtain credentials for the
+	// admin directory API, using google.golang.org/api/impersonate. Lets dex run with a runtime
+	// identity (e.g. workload identity on GKE/GCE, or ServiceAccountFilePath above) that has been
+	// granted roles/iam.serviceAccountTokenCreator on this service account, instead of mounting a
+	// JSON key for a directory-reading service account directly.
+	ImpersonateServiceAccount string `json:"impersonateServiceAccount"`
+
+	// Optional chain of service account emails to impersonate, in order, to reach
+	// ImpersonateServiceAccount. Required when the caller is not directly authorized to impersonate
+	// ImpersonateServiceAccount and must instead go through one or more intermediate accounts.
+	DelegationChain []string `json:"delegationChain"`
+
 	// If this field is true, fetch direct group membership and transitive group membership
 	FetchTransitiveGroupMembership bool `json:"fetchTransitiveGroupMembership"`
 
@@ -60,8 +80,32 @@ type Config struct {
 
 	// Domain is the domain to fetch groups from
 	Domain string `json:"domain"`
+
+	// GroupsKey selects which group attribute is used to populate Identity.Groups: "email"
+	// (default), "name", or "id". Use "id" or "name" when downstream RBAC policies should key on
+	// something more stable or readable than a group's email address. This only reshapes the
+	// returned group values -- it has no effect on how entries in the Groups allow-list above are
+	// looked up, which always requires a valid Directory API groupKey regardless of this setting.
+	// When the Groups allow-list is set and GroupsKey is "email", a matched group is returned as
+	// its allow-list entry as written, which is an alias or ID rather than the primary email when
+	// the entry is given that way.
+	GroupsKey string `json:"groupsKey"`
+
+	// GroupsCacheTTL, if nonzero, caches a user's resolved groups in memory for this long, so that
+	// repeated logins and refreshes don't re-traverse the admin directory API every time. 0
+	// disables the cache.
+	GroupsCacheTTL time.Duration `json:"groupsCacheTTL"`
 }
 
+const (
+	groupsKeyEmail = "email"
+	groupsKeyName  = "name"
+	groupsKeyID    = "id"
+
+	// groupsCacheSize bounds the number of users' group lists held in the in-memory groups cache.
+	groupsCacheSize = 1000
+)
+
 // Open returns a connector which can be used to login users through Google.
 func (c *Config) Open(id string, logger log.Logger) (conn connector.Connector, err error) {
 	ctx, cancel := context.WithCancel(context.Background())
@@ -79,11 +123,18 @@ func (c *Config) Open(id string, logger log.Logger) (conn connector.Connector, e
 		scopes = append(scopes, "profile", "email")
 	}
 
+	switch c.GroupsKey {
+	case "", groupsKeyEmail, groupsKeyName, groupsKeyID:
+	default:
+		cancel()
+		return nil, fmt.Errorf("invalid groupsKey %q: must be one of %q, %q, %q", c.GroupsKey, groupsKeyEmail, groupsKeyName, groupsKeyID)
+	}
+
 	var adminSrv *admin.Service
 
 	// Fixing a regression caused by default config fallback: https://github.com/dexidp/dex/issues/2699
 	if c.FetchGroupsWithDirectoryService {
-		srv, err := createDirectoryService(c.ServiceAccountFilePath, c.AdminEmail, logger)
+		srv, err := createDirectoryService(c.ServiceAccountFilePath, c.AdminEmail, c.ImpersonateServiceAccount, c.DelegationChain, logger)
 		if err != nil {
 			cancel()
 			return nil, fmt.Errorf("could not create directory service: %v", err)
@@ -92,6 +143,11 @@ func (c *Config) Open(id string, logger log.Logger) (conn connector.Connector, e
 		adminSrv = srv
 	}
 
+	var groupsCache *expirable.LRU[string, []string]
+	if c.GroupsCacheTTL > 0 {
+		groupsCache = expirable.NewLRU[string, []string](groupsCacheSize, nil, c.GroupsCacheTTL)
+	}
+
 	clientID := c.ClientID
 	return &googleConnector{
 		redirectURI: c.RedirectURI,
@@ -105,6 +161,7 @@ func (c *Config) Open(id string, logger log.Logger) (conn connector.Connector, e
 		verifier: provider.Verifier(
 			&oidc.Config{ClientID: clientID},
 		),
+		ctx:                            ctx,
 		logger:                         logger,
 		cancel:                         cancel,
 		hostedDomains:                  c.HostedDomains,
@@ -112,8 +169,10 @@ func (c *Config) Open(id string, logger log.Logger) (conn connector.Connector, e
 		serviceAccountFilePath:         c.ServiceAccountFilePath,
 		adminEmail:                     c.AdminEmail,
 		domain:                         c.Domain,
+		groupsKey:                      c.GroupsKey,
 		fetchTransitiveGroupMembership: c.FetchTransitiveGroupMembership,
 		adminSrv:                       adminSrv,
+		groupsCache:                    groupsCache,
 	}, nil
 }
 
@@ -126,15 +185,19 @@ type googleConnector struct {
 	redirectURI                    string
 	oauth2Config                   *oauth2.Config
 	verifier                       *oidc.IDTokenVerifier
+	ctx                            context.Context
 	cancel                         context.CancelFunc
 	logger                         log.Logger
 	hostedDomains                  []string
 	domain                         string
 	groups                         []string
+	groupsKey                      string
 	serviceAccountFilePath         string
 	adminEmail                     string
 	fetchTransitiveGroupMembership bool
 	adminSrv                       *admin.Service
+	groupsCache                    *expirable.LRU[string, []string]
+	groupsSF                       singleflight.Group
 }
 
 func (c *googleConnector) Close() error {
@@ -236,20 +299,13 @@ func (c *googleConnector) createIdentity(ctx context.Context, identity connector
 
 	var groups []string
 	if s.Groups && c.adminSrv != nil {
-		if c.fetchTransitiveGroupMembership {
-			groups, err = c.getAllGroups(ctx, claims.Email)
-		} else {
-			groups, err = c.getGroups(ctx, claims.Email, &sync.Map{})
-		}
+		groups, err = c.getUserGroups(claims.Email)
 		if err != nil {
 			return identity, fmt.Errorf("google: could not retrieve groups: %v", err)
 		}
 
-		if len(c.groups) > 0 {
-			groups = pkg_groups.Filter(groups, c.groups)
-			if len(groups) == 0 {
-				return identity, fmt.Errorf("google: user %q is not in any of the required groups", claims.Username)
-			}
+		if len(c.groups) > 0 && len(groups) == 0 {
+			return identity, fmt.Errorf("google: user %q is not in any of the required groups", claims.Username)
 		}
 	}
 
@@ -264,6 +320,76 @@ func (c *googleConnector) createIdentity(ctx context.Context, identity connector
 	return identity, nil
 }
 
+// getUserGroups resolves email's groups, serving from the groups cache when one is configured.
+// Concurrent lookups for the same email are coalesced via singleflight so that simultaneous
+// HandleCallback/Refresh calls for a user traverse the directory API at most once. The shared
+// fetch runs against the connector's own long-lived context rather than any particular caller's,
+// since a follower coalescing onto an in-flight call must not fail just because the leader's
+// request ended first. A cache miss or expiry falls through to fetchUserGroups; a fetch error is
+// never cached, so callers never get served stale data for a refresh that failed.
+func (c *googleConnector) getUserGroups(email string) ([]string, error) {
+	if c.groupsCache != nil {
+		if groups, ok := c.groupsCache.Get(email); ok {
+			c.logger.Debugf("google: groups cache hit for %q", email)
+			return copyGroups(groups), nil
+		}
+		c.logger.Debugf("google: groups cache miss for %q", email)
+	}
+
+	// Use the connector's own long-lived context for the shared fetch, not the caller's ctx: a
+	// follower that merely coalesces onto this singleflight call must not fail with a spurious
+	// "context canceled" just because the leader's own request context ended first.
+	v, err, _ := c.groupsSF.Do(email, func() (interface{}, error) {
+		// Check the cache again and fill it inside the shared call, so a caller that missed the
+		// cache just as an earlier fetch for the same email completed does not start a second one.
+		if c.groupsCache != nil {
+			if groups, ok := c.groupsCache.Get(email); ok {
+				return groups, nil
+			}
+		}
+		groups, err := c.fetchUserGroups(c.ctx, email)
+		if err != nil {
+			return nil, err
+		}
+		if c.groupsCache != nil {
+			c.groupsCache.Add(email, groups)
+		}
+		return groups, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	groups := v.([]string)
+
+	// groups is shared with the cache and with every other singleflight caller that coalesced onto
+	// this fetch, so callers must each get their own backing array: connector.Identity.Groups is a
+	// plain []string that callers outside this package may append to, and append reusing a shared
+	// backing array would let concurrent requests for the same user race on and clobber it.
+	return copyGroups(groups), nil
+}
+
+// copyGroups returns a defensive copy of groups so callers can freely mutate or append to what
+// they get back without racing with other holders of the same underlying array.
+func copyGroups(groups []string) []string {
+	return append([]string(nil), groups...)
+}
+
+// fetchUserGroups picks the cheapest available strategy for resolving email's groups: checking an
+// allow-list directly when one is configured, otherwise enumerating the user's groups, optionally
+// following transitive membership.
+func (c *googleConnector) fetchUserGroups(ctx context.Context, email string) ([]string, error) {
+	switch {
+	case len(c.groups) > 0:
+		// An allow-list is configured: check membership of each allowed group directly
+		// instead of enumerating every group the user belongs to.
+		return c.getGroupsFromAllowList(ctx, email)
+	case c.fetchTransitiveGroupMembership:
+		return c.getAllGroups(ctx, email)
+	default:
+		return c.getGroups(ctx, email, &sync.Map{})
+	}
+}
+
 func (c *googleConnector) getAllGroups(ctx context.Context, userKey string) ([]string, error) {
 	parentGroups, err := c.adminSrv.Groups.List().
 		UserKey(userKey).
@@ -281,17 +407,18 @@ func (c *googleConnector) getAllGroups(ctx context.Context, userKey string) ([]s
 
 	for _, group := range parentGroups.Groups {
 		email := group.Email
+		key := c.groupKey(group)
 		g.Go(func() error {
 			childGroups, err := c.getGroups(cctx, email, &checkedGroups)
 			if err != nil {
 				return err
 			}
 
-			childGroups = append(childGroups, email)
+			childGroups = append(childGroups, key)
 
-			for _, email := range childGroups {
+			for _, g := range childGroups {
 				select {
-				case groupsCh <- email:
+				case groupsCh <- g:
 				case <-cctx.Done():
 					return cctx.Err()
 				}
@@ -322,6 +449,92 @@ func (c *googleConnector) getAllGroups(ctx context.Context, userKey string) ([]s
 	return groups, nil
 }
 
+// getGroupsFromAllowList checks the user's membership in each of the configured allow-listed
+// groups via Members.HasMember, which natively follows nested groups, instead of enumerating the
+// user's full group list. This keeps the number of directory API calls proportional to
+// len(c.groups) (at most three per allowed group: HasMember, the Members.Get fallback, and
+// Groups.Get for a non-email GroupsKey) rather than to the size of the user's transitive group
+// graph, and lets users authenticate who are
+// members of an allowed group without being part of the GSuite domain itself.
+func (c *googleConnector) getGroupsFromAllowList(ctx context.Context, email string) ([]string, error) {
+	var userGroups []string
+	for _, group := range c.groups {
+		isMember, err := c.isMemberOfGroup(ctx, group, email)
+		if err != nil {
+			return nil, err
+		}
+		if !isMember {
+			continue
+		}
+
+		key, err := c.groupKeyFromAllowListEntry(ctx, group)
+		if err != nil {
+			return nil, err
+		}
+		userGroups = append(userGroups, key)
+	}
+
+	return userGroups, nil
+}
+
+// groupKeyFromAllowListEntry resolves an allow-listed group, identified by the Directory API
+// groupKey configured in c.groups, to the group attribute selected by c.groupsKey. The default
+// "email" requires no extra lookup, since that's the conventional form of a c.groups entry: the
+// entry is returned exactly as configured, so an entry given as an alias or unique ID is returned
+// as that alias or ID, not as the group's primary email. "name" and "id" require fetching the
+// group to read the desired attribute.
+func (c *googleConnector) groupKeyFromAllowListEntry(ctx context.Context, groupKey string) (string, error) {
+	if c.groupsKey == "" || c.groupsKey == groupsKeyEmail {
+		return groupKey, nil
+	}
+
+	group, err := c.adminSrv.Groups.Get(groupKey).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("could not get group %q: %v", groupKey, err)
+	}
+
+	return c.groupKey(group), nil
+}
+
+// isMemberOfGroup reports whether email is a member of groupKey. HasMember returns a 400 when the
+// member's domain differs from the group's primary domain, so on that error we fall back to Get,
+// which works across domains; a 404 there means the user is not a member.
+func (c *googleConnector) isMemberOfGroup(ctx context.Context, groupKey, email string) (bool, error) {
+	hasMember, err := c.adminSrv.Members.HasMember(groupKey, email).Context(ctx).Do()
+	if err == nil {
+		return hasMember.IsMember, nil
+	}
+
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusBadRequest {
+		return false, fmt.Errorf("could not check membership of %q in group %q: %v", email, groupKey, err)
+	}
+
+	_, err = c.adminSrv.Members.Get(groupKey, email).Context(ctx).Do()
+	if err == nil {
+		return true, nil
+	}
+
+	var notFoundErr *googleapi.Error
+	if errors.As(err, &notFoundErr) && notFoundErr.Code == http.StatusNotFound {
+		return false, nil
+	}
+
+	return false, fmt.Errorf("could not get member %q of group %q: %v", email, groupKey, err)
+}
+
+// groupKey returns the group attribute selected by c.groupsKey, defaulting to the group's email.
+func (c *googleConnector) groupKey(group *admin.Group) string {
+	switch c.groupsKey {
+	case groupsKeyName:
+		return group.Name
+	case groupsKeyID:
+		return group.Id
+	default:
+		return group.Email
+	}
+}
+
 // getGroups creates a connection to the admin directory service and lists
 // all groups the user is a member of
 func (c *googleConnector) getGroups(ctx context.Context, email string, checkedGroups *sync.Map) ([]string, error) {
@@ -344,8 +557,7 @@ func (c *googleConnector) getGroups(ctx context.Context, email string, checkedGr
 				continue
 			}
 
-			// TODO (joelspeed): Make desired group key configurable
-			userGroups = append(userGroups, group.Email)
+			userGroups = append(userGroups, c.groupKey(group))
 
 			if !c.fetchTransitiveGroupMembership {
 				continue
@@ -371,8 +583,14 @@ func (c *googleConnector) getGroups(ctx context.Context, email string, checkedGr
 // createDirectoryService sets up super user impersonation and creates an admin client for calling
 // the google admin api. If no serviceAccountFilePath is defined, the application default credential
 // is used.
-func createDirectoryService(serviceAccountFilePath, email string, logger log.Logger) (*admin.Service, error) {
+func createDirectoryService(serviceAccountFilePath, email, impersonateServiceAccount string, delegationChain []string, logger log.Logger) (*admin.Service, error) {
 	ctx := context.Background()
+
+	if impersonateServiceAccount != "" {
+		logger.Warn("creating directory service via service account impersonation chain")
+		return createDirectoryServiceWithImpersonation(ctx, impersonateServiceAccount, delegationChain, serviceAccountFilePath, email)
+	}
+
 	// We know impersonation is required when using a service account credential
 	// TODO: or is it?
 	if email == "" && serviceAccountFilePath == "" {
@@ -417,3 +635,34 @@ func createDirectoryServiceWithWorkloadIdentity(ctx context.Context, logger log.
 
 	return admin.NewService(ctx, option.WithTokenSource(creds.TokenSource))
 }
+
+// createDirectoryServiceWithImpersonation obtains credentials for targetServiceAccount by
+// impersonating through delegates in order, starting from the runtime's own base credentials.
+// If serviceAccountFilePath is set, that JSON key is used as the base identity that performs the
+// impersonation; otherwise the base identity comes from workload identity or ADC. email, if set,
+// is used as the subject for domain-wide delegation once the target service account's credentials
+// have been obtained.
+func createDirectoryServiceWithImpersonation(ctx context.Context, targetServiceAccount string, delegates []string, serviceAccountFilePath, email string) (*admin.Service, error) {
+	scopes := []string{admin.AdminDirectoryGroupReadonlyScope}
+
+	config := impersonate.CredentialsConfig{
+		TargetPrincipal: targetServiceAccount,
+		Scopes:          scopes,
+		Delegates:       delegates,
+	}
+	if email != "" {
+		config.Subject = email
+	}
+
+	var opts []option.ClientOption
+	if serviceAccountFilePath != "" {
+		opts = append(opts, option.WithCredentialsFile(serviceAccountFilePath))
+	}
+
+	ts, err := impersonate.CredentialsTokenSource(ctx, config, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create impersonated credentials for %q: %w", targetServiceAccount, err)
+	}
+
+	return admin.NewService(ctx, option.WithTokenSource(ts))
+}
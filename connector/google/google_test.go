@@ -0,0 +1,300 @@
+package google
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	admin "google.golang.org/api/admin/directory/v1"
+	"google.golang.org/api/option"
+)
+
+// nopLogger discards everything; it exists so tests can exercise code paths that log at debug
+// level without pulling in a real logger implementation.
+type nopLogger struct{}
+
+func (nopLogger) Debug(args ...interface{})                 {}
+func (nopLogger) Info(args ...interface{})                  {}
+func (nopLogger) Warn(args ...interface{})                  {}
+func (nopLogger) Error(args ...interface{})                 {}
+func (nopLogger) Fatal(args ...interface{})                 {}
+func (nopLogger) Debugf(format string, args ...interface{}) {}
+func (nopLogger) Infof(format string, args ...interface{})  {}
+func (nopLogger) Warnf(format string, args ...interface{})  {}
+func (nopLogger) Errorf(format string, args ...interface{}) {}
+func (nopLogger) Fatalf(format string, args ...interface{}) {}
+
+// newTestAdminService points an *admin.Service at an httptest server so the HasMember/Get/List
+// fallback logic can be exercised without talking to the real directory API.
+func newTestAdminService(t *testing.T, handler http.HandlerFunc) *admin.Service {
+	t.Helper()
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	adminSrv, err := admin.NewService(context.Background(),
+		option.WithHTTPClient(srv.Client()),
+		option.WithEndpoint(srv.URL),
+		option.WithoutAuthentication(),
+	)
+	if err != nil {
+		t.Fatalf("failed to create test admin service: %v", err)
+	}
+
+	return adminSrv
+}
+
+func jsonResponse(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func jsonAPIError(w http.ResponseWriter, code int, message string) {
+	jsonResponse(w, code, map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": message,
+		},
+	})
+}
+
+func TestIsMemberOfGroupHasMemberHit(t *testing.T) {
+	adminSrv := newTestAdminService(t, func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.URL.Path, "/hasMember/") {
+			t.Fatalf("unexpected request path: %s", r.URL.Path)
+		}
+		jsonResponse(w, http.StatusOK, &admin.MembersHasMember{IsMember: true})
+	})
+	c := &googleConnector{adminSrv: adminSrv}
+
+	isMember, err := c.isMemberOfGroup(context.Background(), "allowed@example.com", "user@example.com")
+	if err != nil {
+		t.Fatalf("isMemberOfGroup returned error: %v", err)
+	}
+	if !isMember {
+		t.Fatal("expected isMemberOfGroup to report membership")
+	}
+}
+
+// TestIsMemberOfGroupFallsBackOnCrossDomain400 verifies the cross-domain fallback: HasMember
+// returns 400 for a member outside the group's primary domain, so isMemberOfGroup must retry with
+// Members.Get, treating 200 as membership.
+func TestIsMemberOfGroupFallsBackOnCrossDomain400(t *testing.T) {
+	adminSrv := newTestAdminService(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.Contains(r.URL.Path, "/hasMember/"):
+			jsonAPIError(w, http.StatusBadRequest, "member not in group's primary domain")
+		case strings.Contains(r.URL.Path, "/members/"):
+			jsonResponse(w, http.StatusOK, &admin.Member{Email: "user@other-domain.com"})
+		default:
+			t.Fatalf("unexpected request path: %s", r.URL.Path)
+		}
+	})
+	c := &googleConnector{adminSrv: adminSrv}
+
+	isMember, err := c.isMemberOfGroup(context.Background(), "allowed@example.com", "user@other-domain.com")
+	if err != nil {
+		t.Fatalf("isMemberOfGroup returned error: %v", err)
+	}
+	if !isMember {
+		t.Fatal("expected isMemberOfGroup to fall back to Members.Get and report membership")
+	}
+}
+
+func TestIsMemberOfGroupFallsBackToNotFound(t *testing.T) {
+	adminSrv := newTestAdminService(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.Contains(r.URL.Path, "/hasMember/"):
+			jsonAPIError(w, http.StatusBadRequest, "member not in group's primary domain")
+		case strings.Contains(r.URL.Path, "/members/"):
+			jsonAPIError(w, http.StatusNotFound, "not found")
+		default:
+			t.Fatalf("unexpected request path: %s", r.URL.Path)
+		}
+	})
+	c := &googleConnector{adminSrv: adminSrv}
+
+	isMember, err := c.isMemberOfGroup(context.Background(), "allowed@example.com", "stranger@other-domain.com")
+	if err != nil {
+		t.Fatalf("isMemberOfGroup returned error: %v", err)
+	}
+	if isMember {
+		t.Fatal("expected isMemberOfGroup to report non-membership on a 404 from Members.Get")
+	}
+}
+
+func TestGetGroupsFromAllowListOnlyReturnsMatches(t *testing.T) {
+	adminSrv := newTestAdminService(t, func(w http.ResponseWriter, r *http.Request) {
+		jsonResponse(w, http.StatusOK, &admin.MembersHasMember{IsMember: strings.Contains(r.URL.Path, "allowed-a")})
+	})
+	c := &googleConnector{
+		adminSrv: adminSrv,
+		groups:   []string{"allowed-a@example.com", "allowed-b@example.com"},
+	}
+
+	groups, err := c.getGroupsFromAllowList(context.Background(), "user@example.com")
+	if err != nil {
+		t.Fatalf("getGroupsFromAllowList returned error: %v", err)
+	}
+	if len(groups) != 1 || groups[0] != "allowed-a@example.com" {
+		t.Fatalf("expected only the matching allow-listed group, got %v", groups)
+	}
+}
+
+// TestCreateDirectoryServiceWithImpersonationUsesServiceAccountFile verifies that, when
+// serviceAccountFilePath is set, it is wired in as the base credential that performs the
+// impersonation rather than being silently ignored in favor of ADC/workload identity: an invalid
+// credentials file must surface as a credentials error, not succeed (or fail differently) via ADC.
+func TestCreateDirectoryServiceWithImpersonationUsesServiceAccountFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sa.json")
+	if err := os.WriteFile(path, []byte("not a valid service account key"), 0o600); err != nil {
+		t.Fatalf("failed to write fixture service account file: %v", err)
+	}
+
+	_, err := createDirectoryServiceWithImpersonation(context.Background(), "target@project.iam.gserviceaccount.com", nil, path, "")
+	if err == nil {
+		t.Fatal("expected an error when the service account file is invalid")
+	}
+	if !strings.Contains(err.Error(), "impersonated credentials") {
+		t.Fatalf("expected the error to come from setting up impersonated credentials, got: %v", err)
+	}
+}
+
+func TestGroupKeySelectsConfiguredAttribute(t *testing.T) {
+	group := &admin.Group{Email: "team@example.com", Name: "Team", Id: "0123456789"}
+
+	tests := []struct {
+		groupsKey string
+		want      string
+	}{
+		{groupsKey: "", want: group.Email},
+		{groupsKey: groupsKeyEmail, want: group.Email},
+		{groupsKey: groupsKeyName, want: group.Name},
+		{groupsKey: groupsKeyID, want: group.Id},
+	}
+
+	for _, tt := range tests {
+		c := &googleConnector{groupsKey: tt.groupsKey}
+		if got := c.groupKey(group); got != tt.want {
+			t.Errorf("groupsKey %q: groupKey() = %q, want %q", tt.groupsKey, got, tt.want)
+		}
+	}
+}
+
+// TestGroupKeyFromAllowListEntryFetchesGroupForNonEmailKeys verifies that an allow-list lookup
+// result is reshaped according to GroupsKey without changing the lookup key itself: the Directory
+// API is only queried by the configured c.groups entry (email/alias/ID), and Groups.Get is used
+// solely to read back the requested display attribute.
+func TestGroupKeyFromAllowListEntryFetchesGroupForNonEmailKeys(t *testing.T) {
+	adminSrv := newTestAdminService(t, func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.URL.Path, "team") {
+			t.Fatalf("unexpected request path: %s", r.URL.Path)
+		}
+		jsonResponse(w, http.StatusOK, &admin.Group{Email: "team@example.com", Name: "Team", Id: "0123456789"})
+	})
+	c := &googleConnector{adminSrv: adminSrv, groupsKey: groupsKeyName}
+
+	key, err := c.groupKeyFromAllowListEntry(context.Background(), "team@example.com")
+	if err != nil {
+		t.Fatalf("groupKeyFromAllowListEntry returned error: %v", err)
+	}
+	if key != "Team" {
+		t.Fatalf("groupKeyFromAllowListEntry() = %q, want %q", key, "Team")
+	}
+}
+
+// TestGetUserGroupsCachesAndExpires exercises the cache/TTL/singleflight path added for
+// GroupsCacheTTL: concurrent calls for the same email must coalesce into a single fetch, a
+// repeated call within the TTL must be served from cache, and expiry must trigger a fresh fetch.
+func TestGetUserGroupsCachesAndExpires(t *testing.T) {
+	var fetches int32
+	c := &googleConnector{
+		ctx:         context.Background(),
+		logger:      nopLogger{},
+		groupsCache: expirable.NewLRU[string, []string](groupsCacheSize, nil, 50*time.Millisecond),
+	}
+	c.adminSrv = newTestAdminService(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		jsonResponse(w, http.StatusOK, &admin.Groups{Groups: []*admin.Group{{Email: "team@example.com"}}})
+	})
+
+	const concurrency = 10
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			groups, err := c.getUserGroups("user@example.com")
+			if err != nil {
+				t.Errorf("getUserGroups returned error: %v", err)
+				return
+			}
+			if len(groups) != 1 || groups[0] != "team@example.com" {
+				t.Errorf("getUserGroups() = %v, want [team@example.com]", groups)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&fetches); got != 1 {
+		t.Fatalf("expected concurrent lookups for the same user to coalesce into a single fetch, got %d fetches", got)
+	}
+
+	if _, err := c.getUserGroups("user@example.com"); err != nil {
+		t.Fatalf("getUserGroups returned error: %v", err)
+	}
+	if got := atomic.LoadInt32(&fetches); got != 1 {
+		t.Fatalf("expected a cached lookup within the TTL to avoid a new fetch, got %d fetches", got)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err := c.getUserGroups("user@example.com"); err != nil {
+		t.Fatalf("getUserGroups returned error: %v", err)
+	}
+	if got := atomic.LoadInt32(&fetches); got != 2 {
+		t.Fatalf("expected the cache entry to expire and trigger a new fetch, got %d fetches", got)
+	}
+}
+
+// TestGetUserGroupsReturnsIndependentSlices guards against callers sharing a backing array: since
+// connector.Identity.Groups is a plain []string that callers outside this package may append to,
+// every getUserGroups call -- cached or not -- must hand back a slice that's safe to mutate without
+// racing with the cache or with other holders of the same underlying fetch result.
+func TestGetUserGroupsReturnsIndependentSlices(t *testing.T) {
+	c := &googleConnector{
+		ctx:         context.Background(),
+		logger:      nopLogger{},
+		groupsCache: expirable.NewLRU[string, []string](groupsCacheSize, nil, time.Minute),
+	}
+	c.adminSrv = newTestAdminService(t, func(w http.ResponseWriter, r *http.Request) {
+		jsonResponse(w, http.StatusOK, &admin.Groups{Groups: []*admin.Group{{Email: "team@example.com"}}})
+	})
+
+	first, err := c.getUserGroups("user@example.com")
+	if err != nil {
+		t.Fatalf("getUserGroups returned error: %v", err)
+	}
+
+	// Append a caller-local group, as a downstream consumer merging in static groups would.
+	first = append(first, "extra@example.com")
+
+	second, err := c.getUserGroups("user@example.com")
+	if err != nil {
+		t.Fatalf("getUserGroups returned error: %v", err)
+	}
+
+	if len(second) != 1 || second[0] != "team@example.com" {
+		t.Fatalf("a caller's append leaked into another caller's result: got %v", second)
+	}
+}